@@ -1,7 +1,13 @@
 package typeexpr
 
 import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/hcl/v2"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 )
 
 // Defaults represents a type tree which may contain default values for
@@ -24,97 +30,613 @@ type Defaults struct {
 	//
 	// Collections have a single element type, which is stored at key "".
 	Children map[string]*Defaults
+
+	// NullMode controls how Apply treats a null value found where this
+	// node's Type is an object type. The zero value, NullModeUnset, means
+	// "inherit whatever mode is in effect at the parent node", so it only
+	// needs to be set explicitly at the nodes where the mode changes.
+	NullMode NullMode
+
+	// hasDefaultsMu guards hasDefaultsMemo, since the same Defaults tree may
+	// legitimately be shared across concurrent Apply/ApplyPaths calls (for
+	// example a variable's type-defaults reused across many plan values).
+	hasDefaultsMu sync.Mutex
+
+	// hasDefaultsMemo caches the result of hasDefaults, keyed by the
+	// effective NullMode it was computed under, since d's own shape never
+	// changes between calls but the same node can be reached under more
+	// than one inherited NullMode if it's aliased into more than one place
+	// in a tree.
+	hasDefaultsMemo map[NullMode]bool
 }
 
+// NullMode is an enumeration of the ways Defaults.Apply can treat a null
+// object value found in the input.
+type NullMode rune
+
+const (
+	// NullModeUnset means that the node does not override its parent's
+	// NullMode. The root Defaults behaves as NullPreserve if it also
+	// leaves NullMode unset.
+	NullModeUnset NullMode = 0
+
+	// NullPreserve leaves a null object value unchanged. This is the mode
+	// in effect wherever no NullMode is set, including at the root.
+	NullPreserve NullMode = 'P'
+
+	// NullMaterializeIfAllOptional replaces a null object value with one
+	// constructed from defaults, but only if every attribute that has no
+	// default is optional. If any attribute without a default is
+	// required, the null value is preserved instead, since there would be
+	// no way to produce a non-null value for it.
+	NullMaterializeIfAllOptional NullMode = 'O'
+
+	// NullAlwaysMaterialize always replaces a null object value with one
+	// constructed from defaults, leaving any attribute that has neither a
+	// default nor a value as a typed null.
+	NullAlwaysMaterialize NullMode = 'A'
+)
+
 // Apply walks the given value, applying specified defaults wherever optional
 // attributes are missing. The input and output values may have different
 // types, and the result may still require type conversion to the final desired
 // type.
 //
+// Unlike a walk driven by the input value's own type, this descends the tree
+// in the shape described by d.Type, so that a tuple supplied for a
+// list(object(...)) or set(object(...)) variable can have defaults filled in
+// on its elements even though, prior to filling in those defaults, the
+// elements may not share a common type.
+//
+// A null value found in place of an object is, by default, left as-is
+// rather than treated as an object with all attributes missing. This
+// behavior can be changed on a per-node basis via NullMode.
+//
 // This function is permissive and does not report errors, assuming that the
 // caller will have better context to report useful type conversion failure
 // diagnostics.
+//
+// Apply is a thin wrapper around ApplyPaths, kept for backwards
+// compatibility.
 func (d *Defaults) Apply(val cty.Value) cty.Value {
-	val, err := cty.Transform(val, func(path cty.Path, v cty.Value) (cty.Value, error) {
-		// Cannot apply defaults to an unknown value
-		if !v.IsKnown() {
-			return v, nil
-		}
+	return d.ApplyPaths(val)
+}
+
+// ApplyPaths does the same job as Apply, but first consults a memoized
+// summary of which parts of d's own shape could possibly contribute a
+// default value or materialize a null object. A subtree of val is returned
+// completely unchanged, without being copied, once that summary establishes
+// that nothing under the corresponding node of d could affect it.
+//
+// This matters because, without it, applying a Defaults to a large value
+// (for example, a 10k-element list(object(...)) root module input) would
+// reconstruct the entire value one attribute map at a time even when no
+// element actually has a missing optional attribute.
+func (d *Defaults) ApplyPaths(val cty.Value) cty.Value {
+	return d.enter(val, NullPreserve)
+}
 
-		// Look up the defaults for this path.
-		defaults := d.traverse(path)
+// effectiveNullMode returns d.NullMode if it has been set, or inherited
+// otherwise, so that a NullMode only needs to be set at the node where it
+// changes.
+func (d *Defaults) effectiveNullMode(inherited NullMode) NullMode {
+	if d.NullMode == NullModeUnset {
+		return inherited
+	}
+	return d.NullMode
+}
+
+// hasDefaults reports whether d, or anything in its subtree, could either
+// insert a default value or materialize a null object, given mode as d's
+// own effective NullMode. The result depends only on d's shape and mode,
+// neither of which change between calls, so it's memoized on first use per
+// mode. The memo is guarded by a mutex because the same Defaults node can
+// be reached concurrently, both from concurrent top-level Apply calls and,
+// since a node can be aliased as more than one parent's child, under more
+// than one effective mode.
+func (d *Defaults) hasDefaults(mode NullMode) bool {
+	d.hasDefaultsMu.Lock()
+	defer d.hasDefaultsMu.Unlock()
+
+	if has, ok := d.hasDefaultsMemo[mode]; ok {
+		return has
+	}
 
-		// If we have no defaults, nothing to do.
-		if len(defaults) == 0 {
-			return v, nil
+	has := len(d.DefaultValues) > 0
+	if !has && d.Type.IsObjectType() && mode != NullPreserve {
+		// A null value here might get materialized, which counts as a
+		// change even though there's no entry in DefaultValues itself.
+		has = true
+	}
+	if !has {
+		for _, child := range d.Children {
+			if child.hasDefaults(child.effectiveNullMode(mode)) {
+				has = true
+				break
+			}
 		}
+	}
+
+	if d.hasDefaultsMemo == nil {
+		d.hasDefaultsMemo = make(map[NullMode]bool, 1)
+	}
+	d.hasDefaultsMemo[mode] = has
+	return has
+}
 
-		// Ensure we are working with an object or map
-		vt := v.Type()
-		if !vt.IsObjectType() && !vt.IsMapType() {
-			// Cannot apply defaults because the value type is incompatible.
-			// We'll ignore this and let the later conversion stage display a
-			// more useful diagnostic.
-			return v, nil
+// enter applies defaults to val in a pre-order traversal: the node itself is
+// filled in first (so that maps of objects and collections of objects know
+// which attributes are actually present), and then enter recurses into
+// whichever children d.Type says this node has.
+func (d *Defaults) enter(v cty.Value, inherited NullMode) cty.Value {
+	mode := d.effectiveNullMode(inherited)
+	if !d.hasDefaults(mode) {
+		return v
+	}
+
+	if v.IsNull() {
+		return d.applyNull(v, mode)
+	}
+	if !v.IsKnown() {
+		return v
+	}
+
+	switch {
+	case d.Type.IsObjectType():
+		return d.applyAsObject(v, mode)
+	case d.Type.IsMapType():
+		if v.Type().IsObjectType() {
+			return d.applyAsObject(v, mode)
 		}
+		return d.applyAsMap(v, mode)
+	case d.Type.IsListType():
+		return d.applyAsList(v, mode)
+	case d.Type.IsSetType():
+		return d.applyAsSet(v, mode)
+	case d.Type.IsTupleType():
+		return d.applyAsTuple(v, mode)
+	default:
+		return v
+	}
+}
+
+// applyNull handles a null value found at a node, either preserving it or
+// materializing an object from defaults according to mode. Null maps and
+// null values of any other non-object type are always preserved, since
+// NullMode only concerns itself with optional object attributes.
+func (d *Defaults) applyNull(v cty.Value, mode NullMode) cty.Value {
+	if mode == NullPreserve || !d.Type.IsObjectType() {
+		return v
+	}
 
-		// Apply defaults where attributes are missing, constructing a new
-		// value with the same marks.
-		v, valMarks := v.Unmark()
-		attrs := v.AsValueMap()
+	attrTypes := d.Type.AttributeTypes()
 
-		for attr, defaultValue := range defaults {
-			if _, ok := attrs[attr]; !ok {
-				attrs[attr] = defaultValue
+	if mode == NullMaterializeIfAllOptional {
+		for name := range attrTypes {
+			if d.Type.AttributeOptional(name) {
+				continue
 			}
+			if _, ok := d.DefaultValues[name]; !ok {
+				// A required attribute has no default, so there is no
+				// way to materialize a non-null value for it.
+				return v
+			}
+		}
+	}
+
+	attrs := make(map[string]cty.Value, len(attrTypes))
+	for name, attrType := range attrTypes {
+		if defaultValue, ok := d.DefaultValues[name]; ok {
+			attrs[name] = defaultValue
+			continue
+		}
+		attrs[name] = cty.NullVal(attrType)
+	}
+	for name, attrVal := range attrs {
+		if child := d.getChild(name); child != nil {
+			attrs[name] = child.enter(attrVal, mode)
 		}
+	}
+	return cty.ObjectVal(attrs)
+}
+
+// applyAsObject fills in any missing attributes in v using d.DefaultValues,
+// and then recurses into each attribute using the corresponding child
+// Defaults, if any. It allocates a new object only if something actually
+// changed; a map input is always rebuilt as an object, since a default
+// value's type may be incompatible with the map's own element type.
+func (d *Defaults) applyAsObject(v cty.Value, mode NullMode) cty.Value {
+	vt := v.Type()
+	if !vt.IsObjectType() && !vt.IsMapType() {
+		// Cannot apply defaults because the value type is incompatible.
+		// We'll ignore this and let the later conversion stage display a
+		// more useful diagnostic.
+		return v
+	}
+
+	v, marks := v.Unmark()
+	attrs := v.AsValueMap()
+	if attrs == nil {
+		attrs = make(map[string]cty.Value)
+	}
+
+	changed := vt.IsMapType()
+	for attr, defaultValue := range d.DefaultValues {
+		if _, ok := attrs[attr]; !ok {
+			attrs[attr] = defaultValue
+			changed = true
+		}
+	}
 
-		// We construct an object even if the input value was a map, as the
-		// type of an attribute's default value may be incompatible with the
-		// map element type.
-		return cty.ObjectVal(attrs).WithMarks(valMarks), nil
-	})
+	for attr, attrVal := range attrs {
+		child := d.getChild(attr)
+		if child == nil || !child.hasDefaults(child.effectiveNullMode(mode)) {
+			continue
+		}
+		if newVal := child.enter(attrVal, mode); !newVal.RawEquals(attrVal) {
+			attrs[attr] = newVal
+			changed = true
+		}
+	}
 
-	// Our transform callback above should never return an error.
-	if err != nil {
-		panic(err)
+	if !changed {
+		return v.WithMarks(marks)
 	}
 
-	return val
+	// We construct an object even if the input value was a map, as the
+	// type of an attribute's default value may be incompatible with the
+	// map element type.
+	return cty.ObjectVal(attrs).WithMarks(marks)
 }
 
-func (d *Defaults) traverse(path cty.Path) map[string]cty.Value {
-	if len(path) == 0 {
-		return d.DefaultValues
+// applyAsMap recurses into each element of v using the single element
+// Defaults stored at Children[""], keeping the result a map as long as every
+// element still shares a common type afterwards.
+func (d *Defaults) applyAsMap(v cty.Value, mode NullMode) cty.Value {
+	vt := v.Type()
+	if !vt.IsMapType() && !vt.IsObjectType() {
+		return v
 	}
 
-	pathStep := path[0]
-	switch s := pathStep.(type) {
-	case cty.GetAttrStep:
-		if d.Type.IsObjectType() {
-			if child, ok := d.Children[s.Name]; ok {
-				return child.traverse(path[1:])
-			}
+	v, marks := v.Unmark()
+	attrs := v.AsValueMap()
+	child := d.getChild("")
+
+	for key, elem := range attrs {
+		if child != nil {
+			attrs[key] = child.enter(elem, mode)
 		}
+	}
 
-		return nil
-	case cty.IndexStep:
-		if d.Type.IsTupleType() {
-			// Tuples can have different types for each element, so we look
-			// up the defaults based on the index key.
-			if child, ok := d.Children[s.Key.AsBigFloat().String()]; ok {
-				return child.traverse(path[1:])
-			}
-		} else if d.Type.IsCollectionType() {
-			// Defaults for collection element types are stored with a blank
-			// key, so we disregard the index key.
-			if child, ok := d.Children[""]; ok {
-				return child.traverse(path[1:])
-			}
+	if len(attrs) == 0 {
+		return v.WithMarks(marks)
+	}
+	if elems, ok := sameTypeValues(attrs); ok {
+		return cty.MapVal(elems).WithMarks(marks)
+	}
+	return cty.ObjectVal(attrs).WithMarks(marks)
+}
+
+// applyAsList recurses into each element of v using the single element
+// Defaults stored at Children[""]. When the elements are objects, their
+// types are unified after defaults have been applied, since different
+// elements may have had different optional attributes filled in.
+func (d *Defaults) applyAsList(v cty.Value, mode NullMode) cty.Value {
+	vt := v.Type()
+	if !vt.IsListType() && !vt.IsSetType() && !vt.IsTupleType() {
+		return v
+	}
+
+	v, marks := v.Unmark()
+	elems := d.applyAsElements(v, mode)
+	if len(elems) == 0 {
+		return v.WithMarks(marks)
+	}
+	return cty.ListVal(unifyObjectElements(elems)).WithMarks(marks)
+}
+
+// applyAsSet behaves like applyAsList, but rewraps the result as a set.
+func (d *Defaults) applyAsSet(v cty.Value, mode NullMode) cty.Value {
+	vt := v.Type()
+	if !vt.IsListType() && !vt.IsSetType() && !vt.IsTupleType() {
+		return v
+	}
+
+	v, marks := v.Unmark()
+	elems := d.applyAsElements(v, mode)
+	if len(elems) == 0 {
+		return v.WithMarks(marks)
+	}
+	return cty.SetVal(unifyObjectElements(elems)).WithMarks(marks)
+}
+
+// applyAsTuple recurses into each element of v using the per-index Defaults
+// in Children, keyed by strconv.Itoa(i). Unlike the list and set cases,
+// elements are never unified, since the declared type is itself a tuple and
+// so its elements are expected to have independent types.
+func (d *Defaults) applyAsTuple(v cty.Value, mode NullMode) cty.Value {
+	vt := v.Type()
+	if !vt.IsTupleType() && !vt.IsListType() && !vt.IsSetType() {
+		return v
+	}
+
+	v, marks := v.Unmark()
+	elems := v.AsValueSlice()
+	ret := make([]cty.Value, len(elems))
+	for i, elem := range elems {
+		if child := d.getChild(i); child != nil {
+			ret[i] = child.enter(elem, mode)
+		} else {
+			ret[i] = elem
+		}
+	}
+
+	if len(ret) == 0 {
+		return v.WithMarks(marks)
+	}
+	return cty.TupleVal(ret).WithMarks(marks)
+}
+
+// applyAsElements applies the element Defaults (if any) to every element of
+// a list, set, or tuple value, without attempting to unify or rewrap the
+// result.
+func (d *Defaults) applyAsElements(v cty.Value, mode NullMode) []cty.Value {
+	elems := v.AsValueSlice()
+	child := d.getChild("")
+	if child == nil {
+		return elems
+	}
+
+	ret := make([]cty.Value, len(elems))
+	for i, elem := range elems {
+		ret[i] = child.enter(elem, mode)
+	}
+	return ret
+}
+
+// getChild returns the child Defaults for the given key, which may either be
+// a string (an object attribute name, or the "" sentinel used for
+// collections) or an int (a tuple index). If the key's type doesn't match
+// what d.Type expects, getChild returns nil so that callers fall through to
+// the later conversion stage instead of panicking.
+func (d *Defaults) getChild(key interface{}) *Defaults {
+	switch k := key.(type) {
+	case string:
+		switch {
+		case d.Type.IsObjectType():
+			return d.Children[k]
+		case d.Type.IsMapType(), d.Type.IsListType(), d.Type.IsSetType():
+			return d.Children[""]
+		default:
+			return nil
+		}
+	case int:
+		switch {
+		case d.Type.IsTupleType():
+			return d.Children[strconv.Itoa(k)]
+		case d.Type.IsListType(), d.Type.IsSetType():
+			return d.Children[""]
+		default:
+			return nil
 		}
-		return nil
 	default:
-		// At time of writing there are no other path step types.
 		return nil
 	}
 }
+
+// unifyObjectElements unifies the types of elems when they are all object
+// types, converting each element to the unified type. This allows a tuple
+// whose elements only diverged in type because different optional
+// attributes were filled in to still convert cleanly to a list or set.
+//
+// If any element is not an object type, or unification fails, elems is
+// returned unmodified and the later conversion stage is left to report a
+// useful diagnostic.
+func unifyObjectElements(elems []cty.Value) []cty.Value {
+	types := make([]cty.Type, len(elems))
+	for i, elem := range elems {
+		if !elem.Type().IsObjectType() {
+			return elems
+		}
+		types[i] = elem.Type()
+	}
+
+	unified, _ := convert.Unify(types)
+	if unified == cty.NilType {
+		return elems
+	}
+
+	ret := make([]cty.Value, len(elems))
+	for i, elem := range elems {
+		converted, err := convert.Convert(elem, unified)
+		if err != nil {
+			return elems
+		}
+		ret[i] = converted
+	}
+	return ret
+}
+
+// Validate checks d for structural consistency with its own Type, returning
+// diagnostics for any problems found. This catches mistakes that Apply
+// itself stays silent about, such as a default value given for an attribute
+// that doesn't exist, a default value whose type can't convert to the
+// declared attribute type, or a Children entry keyed inconsistently with
+// d.Type.
+//
+// Validate does not have access to the source locations that produced d, so
+// the diagnostics it returns have no Subject range attached. A caller that
+// builds a Defaults from source, such as an HCL decoder, should attach its
+// own range to each diagnostic before surfacing it to the user.
+//
+// This package does not currently contain such a decoder, so nothing calls
+// Validate outside of tests; it's here for whatever builds a Defaults by
+// hand to call before relying on Apply.
+func (d *Defaults) Validate() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	d.validate(&diags)
+	return diags
+}
+
+// MustValidate is like Validate except that it panics if Validate returns
+// any error diagnostics, for use in contexts such as tests where a Defaults
+// is expected to already be known-valid.
+func (d *Defaults) MustValidate() {
+	if diags := d.Validate(); diags.HasErrors() {
+		panic(diags.Error())
+	}
+}
+
+func (d *Defaults) validate(diags *hcl.Diagnostics) {
+	switch {
+	case d.Type.IsObjectType():
+		d.validateObject(diags)
+	case d.Type.IsMapType():
+		d.validateCollection(diags, d.Type.ElementType())
+	case d.Type.IsListType(), d.Type.IsSetType():
+		d.validateCollection(diags, d.Type.ElementType())
+	case d.Type.IsTupleType():
+		d.validateTuple(diags)
+	default:
+		if len(d.DefaultValues) > 0 || len(d.Children) > 0 {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid default value placement",
+				Detail:   fmt.Sprintf("Default values are not supported for type %s.", d.Type.FriendlyName()),
+			})
+		}
+	}
+}
+
+func (d *Defaults) validateObject(diags *hcl.Diagnostics) {
+	attrTypes := d.Type.AttributeTypes()
+
+	for attr, defaultValue := range d.DefaultValues {
+		attrType, ok := attrTypes[attr]
+		if !ok {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Default value for undeclared attribute",
+				Detail:   fmt.Sprintf("Attribute %q has a default value but is not present in the object type.", attr),
+			})
+			continue
+		}
+		if _, err := convert.Convert(defaultValue, attrType); err != nil {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid default value",
+				Detail:   fmt.Sprintf("Default value for attribute %q is not compatible with the attribute's type: %s.", attr, err),
+			})
+		}
+	}
+
+	for key, child := range d.Children {
+		if key == "" {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid default value placement",
+				Detail:   "Object type defaults must be keyed by attribute name, not the empty string used for collection element types.",
+			})
+			continue
+		}
+		attrType, ok := attrTypes[key]
+		if !ok {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Default value for undeclared attribute",
+				Detail:   fmt.Sprintf("Attribute %q has nested defaults but is not present in the object type.", key),
+			})
+			continue
+		}
+		if !child.Type.Equals(attrType) {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Inconsistent default value type",
+				Detail:   fmt.Sprintf("Nested defaults for attribute %q declare type %s, which does not match the object's attribute type %s.", key, child.Type.FriendlyName(), attrType.FriendlyName()),
+			})
+			continue
+		}
+		child.validate(diags)
+	}
+}
+
+func (d *Defaults) validateCollection(diags *hcl.Diagnostics, elemType cty.Type) {
+	if len(d.DefaultValues) > 0 {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid default value placement",
+			Detail:   "Default values are not supported directly on a collection type; set them on the collection's element type instead.",
+		})
+	}
+
+	for key, child := range d.Children {
+		if key != "" {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid default value placement",
+				Detail:   fmt.Sprintf("Collection element defaults must be keyed by the empty string, not %q.", key),
+			})
+			continue
+		}
+		if !child.Type.Equals(elemType) {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Inconsistent default value type",
+				Detail:   fmt.Sprintf("Nested defaults declare type %s, which does not match the collection's element type %s.", child.Type.FriendlyName(), elemType.FriendlyName()),
+			})
+			continue
+		}
+		child.validate(diags)
+	}
+}
+
+func (d *Defaults) validateTuple(diags *hcl.Diagnostics) {
+	if len(d.DefaultValues) > 0 {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid default value placement",
+			Detail:   "Default values are not supported directly on a tuple type; set them on each element's own Defaults instead.",
+		})
+	}
+
+	elemTypes := d.Type.TupleElementTypes()
+	for key, child := range d.Children {
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 || idx >= len(elemTypes) {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tuple element index",
+				Detail:   fmt.Sprintf("Key %q is not a valid element index for a tuple of length %d.", key, len(elemTypes)),
+			})
+			continue
+		}
+		if !child.Type.Equals(elemTypes[idx]) {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Inconsistent default value type",
+				Detail:   fmt.Sprintf("Nested defaults for tuple element %d declare type %s, which does not match the tuple's element type %s.", idx, child.Type.FriendlyName(), elemTypes[idx].FriendlyName()),
+			})
+			continue
+		}
+		child.validate(diags)
+	}
+}
+
+// sameTypeValues returns attrs unmodified along with true if every value in
+// the map shares the same type, which is required in order to rewrap a map
+// of processed elements back into a cty.Map.
+func sameTypeValues(attrs map[string]cty.Value) (map[string]cty.Value, bool) {
+	var ty cty.Type
+	first := true
+	for _, v := range attrs {
+		if first {
+			ty = v.Type()
+			first = false
+			continue
+		}
+		if !v.Type().Equals(ty) {
+			return nil, false
+		}
+	}
+	return attrs, true
+}
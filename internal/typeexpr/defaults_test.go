@@ -1,12 +1,115 @@
 package typeexpr
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/zclconf/go-cty/cty"
 )
 
+func TestDefaults_Validate(t *testing.T) {
+	simpleObject := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a": cty.String,
+		"b": cty.Bool,
+	}, []string{"b"})
+
+	testCases := map[string]struct {
+		defaults  *Defaults
+		wantError bool
+	}{
+		"valid defaults": {
+			defaults: &Defaults{
+				Type: simpleObject,
+				DefaultValues: map[string]cty.Value{
+					"b": cty.True,
+				},
+			},
+			wantError: false,
+		},
+		"default value for unknown attribute": {
+			defaults: &Defaults{
+				Type: simpleObject,
+				DefaultValues: map[string]cty.Value{
+					"c": cty.True,
+				},
+			},
+			wantError: true,
+		},
+		"default value incompatible with attribute type": {
+			defaults: &Defaults{
+				Type: simpleObject,
+				DefaultValues: map[string]cty.Value{
+					"b": cty.ListValEmpty(cty.String),
+				},
+			},
+			wantError: true,
+		},
+		"child type mismatched with attribute type": {
+			defaults: &Defaults{
+				Type: cty.Object(map[string]cty.Type{
+					"a": cty.String,
+				}),
+				Children: map[string]*Defaults{
+					"a": {
+						Type: cty.Number,
+					},
+				},
+			},
+			wantError: true,
+		},
+		"tuple child key is not a valid index": {
+			defaults: &Defaults{
+				Type: cty.Tuple([]cty.Type{cty.String, cty.Number}),
+				Children: map[string]*Defaults{
+					"not-a-number": {
+						Type: cty.String,
+					},
+				},
+			},
+			wantError: true,
+		},
+		"collection child keyed by something other than the empty string": {
+			defaults: &Defaults{
+				Type: cty.List(cty.String),
+				Children: map[string]*Defaults{
+					"0": {
+						Type: cty.String,
+					},
+				},
+			},
+			wantError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			diags := tc.defaults.Validate()
+			if got := diags.HasErrors(); got != tc.wantError {
+				t.Errorf("wrong result\ngot:  %t\nwant: %t\ndiags: %s", got, tc.wantError, diags)
+			}
+		})
+	}
+}
+
+func TestDefaults_MustValidate_panics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected MustValidate to panic, but it did not")
+		}
+	}()
+
+	d := &Defaults{
+		Type: cty.Object(map[string]cty.Type{
+			"a": cty.String,
+		}),
+		DefaultValues: map[string]cty.Value{
+			"missing": cty.True,
+		},
+	}
+	d.MustValidate()
+}
+
 var (
 	valueComparer = cmp.Comparer(cty.Value.RawEquals)
 )
@@ -20,6 +123,10 @@ func TestDefaults_Apply(t *testing.T) {
 		"c": simpleObject,
 		"d": cty.Number,
 	}, []string{"c"})
+	dynamicAttrObject := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a":     cty.String,
+		"extra": cty.DynamicPseudoType,
+	}, []string{"extra"})
 
 	testCases := map[string]struct {
 		defaults *Defaults
@@ -90,7 +197,7 @@ func TestDefaults_Apply(t *testing.T) {
 					"a": cty.StringVal("bar"),
 				}),
 			}),
-			want: cty.TupleVal([]cty.Value{
+			want: cty.ListVal([]cty.Value{
 				cty.ObjectVal(map[string]cty.Value{
 					"a": cty.StringVal("foo"),
 					"b": cty.True,
@@ -170,6 +277,102 @@ func TestDefaults_Apply(t *testing.T) {
 				}),
 			}),
 		},
+		"tuple of objects with divergent optional attributes converted to list(object(...))": {
+			defaults: &Defaults{
+				Type: cty.List(simpleObject),
+				Children: map[string]*Defaults{
+					"": {
+						Type: simpleObject,
+						DefaultValues: map[string]cty.Value{
+							"b": cty.True,
+						},
+					},
+				},
+			},
+			value: cty.TupleVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("foo"),
+				}),
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("bar"),
+					"b": cty.False,
+				}),
+			}),
+			want: cty.ListVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("foo"),
+					"b": cty.True,
+				}),
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("bar"),
+					"b": cty.False,
+				}),
+			}),
+		},
+		"tuple of objects with divergent optional attributes converted to set(object(...))": {
+			defaults: &Defaults{
+				Type: cty.Set(simpleObject),
+				Children: map[string]*Defaults{
+					"": {
+						Type: simpleObject,
+						DefaultValues: map[string]cty.Value{
+							"b": cty.True,
+						},
+					},
+				},
+			},
+			value: cty.TupleVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("foo"),
+				}),
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("bar"),
+					"b": cty.False,
+				}),
+			}),
+			want: cty.SetVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("foo"),
+					"b": cty.True,
+				}),
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("bar"),
+					"b": cty.False,
+				}),
+			}),
+		},
+		"mixed tuple of objects converted to list(object(...)) with a dynamically typed attribute": {
+			defaults: &Defaults{
+				Type: cty.List(dynamicAttrObject),
+				Children: map[string]*Defaults{
+					"": {
+						Type: dynamicAttrObject,
+						DefaultValues: map[string]cty.Value{
+							"extra": cty.StringVal("default"),
+						},
+					},
+				},
+			},
+			value: cty.TupleVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("foo"),
+				}),
+				cty.ObjectVal(map[string]cty.Value{
+					"a":     cty.StringVal("bar"),
+					"extra": cty.NumberIntVal(5),
+				}),
+			}),
+			want: cty.ListVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a":     cty.StringVal("foo"),
+					"extra": cty.StringVal("default"),
+				}),
+				cty.ObjectVal(map[string]cty.Value{
+					"a":     cty.StringVal("bar"),
+					"extra": cty.StringVal("5"),
+				}),
+			}),
+		},
 	}
 
 	for name, tc := range testCases {
@@ -181,3 +384,319 @@ func TestDefaults_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaults_Apply_null(t *testing.T) {
+	simpleObject := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a": cty.String,
+		"b": cty.Bool,
+	}, []string{"b"})
+	requiredObject := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a": cty.String,
+		"b": cty.Bool,
+	}, []string{})
+
+	testCases := map[string]struct {
+		defaults *Defaults
+		value    cty.Value
+		want     cty.Value
+	}{
+		"null element inside list(object(...)) is preserved by default": {
+			defaults: &Defaults{
+				Type: cty.List(simpleObject),
+				Children: map[string]*Defaults{
+					"": {
+						Type: simpleObject,
+						DefaultValues: map[string]cty.Value{
+							"b": cty.True,
+						},
+					},
+				},
+			},
+			value: cty.TupleVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("foo"),
+				}),
+				cty.NullVal(simpleObject),
+			}),
+			// The non-null element ends up with a plain (non-optional)
+			// object type once "b" is filled in, and the null element is
+			// unified to that same type so the two can share a list.
+			want: cty.ListVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("foo"),
+					"b": cty.True,
+				}),
+				cty.NullVal(cty.Object(map[string]cty.Type{
+					"a": cty.String,
+					"b": cty.Bool,
+				})),
+			}),
+		},
+		"top-level null object is preserved with NullPreserve": {
+			defaults: &Defaults{
+				Type: simpleObject,
+				DefaultValues: map[string]cty.Value{
+					"b": cty.True,
+				},
+				NullMode: NullPreserve,
+			},
+			value: cty.NullVal(simpleObject),
+			want:  cty.NullVal(simpleObject),
+		},
+		"top-level null object materialized when all required attributes have defaults": {
+			defaults: &Defaults{
+				Type: simpleObject,
+				DefaultValues: map[string]cty.Value{
+					"a": cty.StringVal("default-a"),
+					"b": cty.True,
+				},
+				NullMode: NullMaterializeIfAllOptional,
+			},
+			value: cty.NullVal(simpleObject),
+			want: cty.ObjectVal(map[string]cty.Value{
+				"a": cty.StringVal("default-a"),
+				"b": cty.True,
+			}),
+		},
+		"top-level null object left null when a required attribute has no default": {
+			defaults: &Defaults{
+				Type: requiredObject,
+				DefaultValues: map[string]cty.Value{
+					"b": cty.True,
+				},
+				NullMode: NullMaterializeIfAllOptional,
+			},
+			value: cty.NullVal(requiredObject),
+			want:  cty.NullVal(requiredObject),
+		},
+		"nested null object always materialized with NullAlwaysMaterialize, leaving required attributes null": {
+			defaults: &Defaults{
+				Type: cty.Object(map[string]cty.Type{
+					"c": requiredObject,
+				}),
+				NullMode: NullAlwaysMaterialize,
+				Children: map[string]*Defaults{
+					"c": {
+						Type: requiredObject,
+						DefaultValues: map[string]cty.Value{
+							"b": cty.True,
+						},
+					},
+				},
+			},
+			value: cty.ObjectVal(map[string]cty.Value{
+				"c": cty.NullVal(requiredObject),
+			}),
+			want: cty.ObjectVal(map[string]cty.Value{
+				"c": cty.ObjectVal(map[string]cty.Value{
+					"a": cty.NullVal(cty.String),
+					"b": cty.True,
+				}),
+			}),
+		},
+		"top-level null object always materialized with NullAlwaysMaterialize, leaving required attributes null": {
+			defaults: &Defaults{
+				Type: requiredObject,
+				DefaultValues: map[string]cty.Value{
+					"b": cty.True,
+				},
+				NullMode: NullAlwaysMaterialize,
+			},
+			value: cty.NullVal(requiredObject),
+			want: cty.ObjectVal(map[string]cty.Value{
+				"a": cty.NullVal(cty.String),
+				"b": cty.True,
+			}),
+		},
+		"nested null object materialized with NullMaterializeIfAllOptional when all required attributes have defaults": {
+			defaults: &Defaults{
+				Type: cty.Object(map[string]cty.Type{
+					"c": simpleObject,
+				}),
+				NullMode: NullMaterializeIfAllOptional,
+				Children: map[string]*Defaults{
+					"c": {
+						Type: simpleObject,
+						DefaultValues: map[string]cty.Value{
+							"a": cty.StringVal("default-a"),
+							"b": cty.True,
+						},
+					},
+				},
+			},
+			value: cty.ObjectVal(map[string]cty.Value{
+				"c": cty.NullVal(simpleObject),
+			}),
+			want: cty.ObjectVal(map[string]cty.Value{
+				"c": cty.ObjectVal(map[string]cty.Value{
+					"a": cty.StringVal("default-a"),
+					"b": cty.True,
+				}),
+			}),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := tc.defaults.Apply(tc.value)
+			if !cmp.Equal(tc.want, got, valueComparer) {
+				t.Errorf("wrong result\n%s", cmp.Diff(tc.want, got, valueComparer))
+			}
+		})
+	}
+}
+
+// TestDefaults_Apply_sharedNodeDifferentNullModes covers a *Defaults node
+// that is reached under two different effective NullModes: once as the
+// root of its own Apply call, and once as a child of a parent whose
+// NullMode differs from that root call. hasDefaults memoizes per node, so
+// this guards against the memo from the first call leaking into the
+// second, which would otherwise happen if the memo weren't keyed by mode.
+func TestDefaults_Apply_sharedNodeDifferentNullModes(t *testing.T) {
+	simpleObject := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a": cty.String,
+		"b": cty.Bool,
+	}, []string{"b"})
+
+	elem := &Defaults{
+		Type: simpleObject,
+	}
+
+	got := elem.Apply(cty.NullVal(simpleObject))
+	want := cty.NullVal(simpleObject)
+	if !cmp.Equal(want, got, valueComparer) {
+		t.Fatalf("wrong result applying elem directly under inherited NullPreserve\n%s", cmp.Diff(want, got, valueComparer))
+	}
+
+	parent := &Defaults{
+		Type: cty.Object(map[string]cty.Type{
+			"x": simpleObject,
+		}),
+		NullMode: NullAlwaysMaterialize,
+		Children: map[string]*Defaults{
+			"x": elem,
+		},
+	}
+
+	got = parent.Apply(cty.ObjectVal(map[string]cty.Value{
+		"x": cty.NullVal(simpleObject),
+	}))
+	want = cty.ObjectVal(map[string]cty.Value{
+		"x": cty.ObjectVal(map[string]cty.Value{
+			"a": cty.NullVal(cty.String),
+			"b": cty.NullVal(cty.Bool),
+		}),
+	})
+	if !cmp.Equal(want, got, valueComparer) {
+		t.Fatalf("wrong result applying the same elem as a child under inherited NullAlwaysMaterialize\n%s", cmp.Diff(want, got, valueComparer))
+	}
+}
+
+// TestDefaults_Apply_concurrent exercises the same Defaults tree from many
+// goroutines at once, the way a single variable's type-defaults might be
+// reused across many concurrent plan evaluations. It exists to be run with
+// -race: hasDefaults memoizes onto the Defaults node itself, so without
+// synchronization this would otherwise be a data race.
+func TestDefaults_Apply_concurrent(t *testing.T) {
+	simpleObject := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a": cty.String,
+		"b": cty.Bool,
+	}, []string{"b"})
+
+	defaults := &Defaults{
+		Type: cty.List(simpleObject),
+		Children: map[string]*Defaults{
+			"": {
+				Type: simpleObject,
+				DefaultValues: map[string]cty.Value{
+					"b": cty.True,
+				},
+			},
+		},
+	}
+
+	val := cty.TupleVal([]cty.Value{
+		cty.ObjectVal(map[string]cty.Value{
+			"a": cty.StringVal("foo"),
+		}),
+	})
+	want := cty.ListVal([]cty.Value{
+		cty.ObjectVal(map[string]cty.Value{
+			"a": cty.StringVal("foo"),
+			"b": cty.True,
+		}),
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := defaults.Apply(val)
+			if !cmp.Equal(want, got, valueComparer) {
+				t.Errorf("wrong result\n%s", cmp.Diff(want, got, valueComparer))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDefaults_ApplyPaths_noDefaultsIsNoOp(t *testing.T) {
+	elemType := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a": cty.String,
+		"b": cty.Bool,
+	}, []string{"b"})
+
+	defaults := &Defaults{
+		Type: cty.List(elemType),
+		Children: map[string]*Defaults{
+			"": {
+				Type: elemType,
+			},
+		},
+	}
+
+	elems := make([]cty.Value, 1000)
+	for i := range elems {
+		elems[i] = cty.ObjectVal(map[string]cty.Value{
+			"a": cty.StringVal("foo"),
+			"b": cty.True,
+		})
+	}
+	val := cty.ListVal(elems)
+
+	got := defaults.ApplyPaths(val)
+	if !got.RawEquals(val) {
+		t.Fatalf("wrong result\n%s", cmp.Diff(val, got, valueComparer))
+	}
+}
+
+func BenchmarkDefaults_ApplyPaths_noDefaultsNeeded(b *testing.B) {
+	elemType := cty.ObjectWithOptionalAttrs(map[string]cty.Type{
+		"a": cty.String,
+		"b": cty.Bool,
+	}, []string{"b"})
+
+	defaults := &Defaults{
+		Type: cty.List(elemType),
+		Children: map[string]*Defaults{
+			"": {
+				Type: elemType,
+			},
+		},
+	}
+
+	elems := make([]cty.Value, 10000)
+	for i := range elems {
+		elems[i] = cty.ObjectVal(map[string]cty.Value{
+			"a": cty.StringVal("foo"),
+			"b": cty.True,
+		})
+	}
+	val := cty.ListVal(elems)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		defaults.ApplyPaths(val)
+	}
+}